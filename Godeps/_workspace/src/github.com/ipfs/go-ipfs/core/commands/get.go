@@ -3,25 +3,46 @@ package commands
 import (
 	"bufio"
 	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	gopath "path"
 	"strings"
+	"time"
 
 	"github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/cheggaaa/pb"
 	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
 
 	cmds "github.com/ipfs/go-ipfs/commands"
 	core "github.com/ipfs/go-ipfs/core"
+	dag "github.com/ipfs/go-ipfs/merkledag"
 	path "github.com/ipfs/go-ipfs/path"
+	"github.com/ipfs/go-ipfs/thirdparty/pgzip"
 	tar "github.com/ipfs/go-ipfs/thirdparty/tar"
+	ft "github.com/ipfs/go-ipfs/unixfs"
 	uio "github.com/ipfs/go-ipfs/unixfs/io"
+	ftpb "github.com/ipfs/go-ipfs/unixfs/pb"
 	utar "github.com/ipfs/go-ipfs/unixfs/tar"
 )
 
 var ErrInvalidCompressionLevel = errors.New("Compression level must be between 1 and 9")
+var ErrInvalidParallelism = errors.New("Number of parallel workers must not be negative")
+
+// sizeWalkTimeout bounds how long get will spend walking a DAG to
+// compute its total size before giving up and falling back to an
+// indeterminate progress bar.
+const sizeWalkTimeout = 30 * time.Second
+
+// tarBlockSize is the fixed block size used by the tar format for
+// headers and payload padding.
+const tarBlockSize = 512
+
+// tarEndOfArchiveSize is the two all-zero blocks tar.Writer.Close
+// appends after the last entry, marking the end of the archive.
+const tarEndOfArchiveSize = 2 * tarBlockSize
 
 var GetCmd = &cmds.Command{
 	Helptext: cmds.HelpText{
@@ -36,6 +57,29 @@ To output a TAR archive instead of unpacked files, use '--archive' or '-a'.
 
 To compress the output with GZIP compression, use '--compress' or '-C'. You
 may also specify the level of compression by specifying '-l=<1-9>'.
+
+To pick the archive container, use '--format=<tar|tar.gz|tar.xz|tar.zst|zip>'
+(implies '--archive'). This replaces the fixed tar/tar.gz pairing of
+'--archive'/'--compress' with any registered format, including a true zip
+archive that tools other than tar can read directly.
+
+GZIP compression of large objects can be parallelized across a block-gzip
+worker pool with '--parallel' / '-j=<N>' (0, the default, uses one worker per
+core; 1 forces the original single-goroutine path).
+
+'--seekable' produces a tar.gz laid out per the eStargz convention: every
+file is chunked and each chunk is its own independent gzip member, with a
+trailing index that lets a client fetch and decompress a single file via an
+HTTP range request instead of downloading the whole archive. Chunk size can
+be set with '--chunk-size' (default 4MiB).
+
+'--cdc' re-chunks file content with a rolling-hash splitter before writing
+it into the archive, instead of using the raw UnixFS block boundaries.
+Chunk boundaries then depend only on file content, so two unrelated 'ipfs
+get' runs over overlapping data tend to agree on where chunks fall. A
+sidecar manifest mapping each chunk's digest to its offset and length in
+the archive is written alongside the output, at '<output>.chunks.json'.
+The target average chunk size can be set with '--cdc-avg' (default 1MiB).
 `,
 	},
 
@@ -47,10 +91,28 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		cmds.BoolOption("archive", "a", "Output a TAR archive"),
 		cmds.BoolOption("compress", "C", "Compress the output with GZIP compression"),
 		cmds.IntOption("compression-level", "l", "The level of compression (1-9)"),
+		cmds.StringOption("format", "f", "Archive format: tar, tar.gz, tar.xz, tar.zst, zip (implies --archive)"),
+		cmds.IntOption("parallel", "j", "Number of goroutines used to GZIP compress (0 = auto, 1 = serial)"),
+		cmds.BoolOption("seekable", "Output a chunk-addressable, eStargz-style seekable tar.gz"),
+		cmds.IntOption("chunk-size", "Chunk size in bytes for --seekable output (default 4MiB)"),
+		cmds.BoolOption("cdc", "Re-chunk file content with a rolling hash and write a <output>.chunks.json manifest"),
+		cmds.IntOption("cdc-avg", "Target average chunk size in bytes for --cdc output (default 1MiB)"),
 	},
 	PreRun: func(req cmds.Request) error {
-		_, err := getCompressOptions(req)
-		return err
+		if _, err := getCompressOptions(req); err != nil {
+			return err
+		}
+		if _, err := getParallelOption(req); err != nil {
+			return err
+		}
+		format, err := getArchiveFormat(req)
+		if err != nil {
+			return err
+		}
+		if cdc, _, _ := req.Option("cdc").Bool(); cdc && !utar.SupportsCDC(format) {
+			return fmt.Errorf("--cdc is not supported with the %q format", format.Extension())
+		}
+		return nil
 	},
 	Run: func(req cmds.Request, res cmds.Response) {
 		cmplvl, err := getCompressOptions(req)
@@ -66,24 +128,90 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		}
 
 		p := path.Path(req.Arguments()[0])
+
+		dn, err := core.Resolve(req.Context(), node, p)
+		if err != nil {
+			res.SetError(err, cmds.ErrNormal)
+			return
+		}
+
+		if seekable, _, _ := req.Option("seekable").Bool(); seekable {
+			chunkSize, _, _ := req.Option("chunk-size").Int()
+			total := boundedArchiveSize(req.Context(), dn, node.DAG)
+			bar := newArchiveBar(total)
+			reader, err := utar.DagArchiveSeekable(req.Context(), dn, p.String(), node.DAG, int64(chunkSize), barWriter{bar})
+			if err != nil {
+				res.SetError(err, cmds.ErrNormal)
+				return
+			}
+			res.SetOutput(&sizedReader{Reader: reader, Size: total, Ext: ".tar.gz", Bar: bar})
+			return
+		}
+
+		archive, _, _ := req.Option("archive").Bool()
+		_, formatGiven, _ := req.Option("format").String()
+
+		if cdc, _, _ := req.Option("cdc").Bool(); cdc {
+			avg, _, _ := req.Option("cdc-avg").Int()
+			format, err := getArchiveFormat(req)
+			if err != nil {
+				res.SetError(err, cmds.ErrNormal)
+				return
+			}
+			total := boundedArchiveSize(req.Context(), dn, node.DAG)
+			bar := newArchiveBar(total)
+			reader, manifest, err := utar.DagArchiveCDC(req.Context(), dn, p.String(), node.DAG, format, int64(avg), barWriter{bar})
+			if err != nil {
+				res.SetError(err, cmds.ErrNormal)
+				return
+			}
+			res.SetOutput(&sizedReader{Reader: reader, Size: total, Ext: format.Extension(), CDC: manifest, Bar: bar})
+			return
+		}
+
 		var reader io.Reader
-		if archive, _, _ := req.Option("archive").Bool(); !archive && cmplvl != gzip.NoCompression {
-			// only use this when the flag is '-C' without '-a'
-			reader, err = getZip(req.Context(), node, p, cmplvl)
+		var total uint64
+		var ext string
+		var bar *pb.ProgressBar
+		if !archive && !formatGiven && cmplvl != gzip.NoCompression {
+			// only use this when the flag is '-C' without '-a' or '-f'
+			var workers int
+			workers, err = getParallelOption(req)
+			if err == nil {
+				total = boundedDagSize(req.Context(), dn, node.DAG)
+				bar = newArchiveBar(total)
+				reader, err = getZip(req.Context(), node, dn, cmplvl, workers, barWriter{bar})
+			}
 		} else {
-			reader, err = get(req.Context(), node, p, cmplvl)
+			var format utar.ArchiveWriter
+			format, err = getArchiveFormat(req)
+			if err == nil {
+				ext = format.Extension()
+				if utar.UsesTarFraming(format) {
+					total = boundedArchiveSize(req.Context(), dn, node.DAG)
+				} else {
+					// zip (or any other dagArchiver) lays out its own
+					// entries rather than wrapping a tar stream, so
+					// progress - teed around the raw file-content copy
+					// in writeDagToZip - only ever sees the plain DAG
+					// bytes, not tar's per-entry overhead.
+					total = boundedDagSize(req.Context(), dn, node.DAG)
+				}
+				bar = newArchiveBar(total)
+				reader, err = get(req.Context(), node, dn, p, format, barWriter{bar})
+			}
 		}
 		if err != nil {
 			res.SetError(err, cmds.ErrNormal)
 			return
 		}
-		res.SetOutput(reader)
+		res.SetOutput(&sizedReader{Reader: reader, Size: total, Ext: ext, Bar: bar})
 	},
 	PostRun: func(req cmds.Request, res cmds.Response) {
 		if res.Output() == nil {
 			return
 		}
-		outReader := res.Output().(io.Reader)
+		outReader := res.Output().(*sizedReader)
 		res.SetOutput(nil)
 
 		outPath, _, _ := req.Option("output").String()
@@ -99,28 +227,98 @@ may also specify the level of compression by specifying '-l=<1-9>'.
 		}
 
 		archive, _, _ := req.Option("archive").Bool()
+		_, formatGiven, _ := req.Option("format").String()
+		seekable, _, _ := req.Option("seekable").Bool()
+		cdc, _, _ := req.Option("cdc").Bool()
+		archive = archive || formatGiven || seekable || cdc
 
 		gw := getWriter{
 			Out:         os.Stdout,
 			Err:         os.Stderr,
 			Archive:     archive,
 			Compression: cmplvl,
+			Size:        outReader.Size,
+			Ext:         outReader.Ext,
+			Bar:         outReader.Bar,
 		}
 
-		if err := gw.Write(outReader, outPath); err != nil {
+		if err := gw.Write(outReader.Reader, outPath); err != nil {
 			res.SetError(err, cmds.ErrNormal)
 			return
 		}
+
+		if outReader.CDC != nil {
+			if err := writeCDCManifest(<-outReader.CDC, outPath, gw.Ext); err != nil {
+				res.SetError(err, cmds.ErrNormal)
+				return
+			}
+		}
 	},
 }
 
-func progressBarForReader(out io.Writer, r io.Reader) (*pb.ProgressBar, *pb.Reader) {
-	// setup bar reader
-	// TODO: get total length of files
-	bar := pb.New(0).SetUnits(pb.U_BYTES)
-	bar.Output = out
-	barR := bar.NewProxyReader(r)
-	return bar, barR
+// writeCDCManifest writes result's manifest as JSON to
+// "<outPath+ext>.chunks.json", next to the archive '--cdc' just wrote.
+func writeCDCManifest(result utar.CDCResult, outPath, ext string) error {
+	if result.Err != nil {
+		return result.Err
+	}
+
+	archivePath := outPath
+	if ext != "" && !strings.HasSuffix(archivePath, ext) {
+		archivePath += ext
+	}
+
+	data, err := json.MarshalIndent(result.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(archivePath+".chunks.json", data, 0644)
+}
+
+// sizedReader pairs the reader returned by get/getZip with the
+// precomputed pre-compression byte total its progress bar is sized
+// to, so PostRun gets a bar with a real maximum instead of an
+// indeterminate one.
+type sizedReader struct {
+	io.Reader
+
+	// Size is the precomputed total, or 0 if it could not be
+	// determined within sizeWalkTimeout.
+	Size uint64
+
+	// Ext is the filename suffix for the archive format used to
+	// produce this reader, or "" when it isn't a registered archive
+	// format (e.g. the raw '-C'-only gzip path).
+	Ext string
+
+	// CDC carries the content-defined-chunking manifest for
+	// '--cdc' output, or nil otherwise. PostRun receives from it only
+	// after the archive has been fully written to disk.
+	CDC <-chan utar.CDCResult
+
+	// Bar is already tracking real progress by the time PostRun sees
+	// it: Run wires it into the archive-producing function itself (as
+	// a barWriter) so it counts uncompressed/pre-archive bytes as
+	// they're produced, rather than bytes read back out of Reader -
+	// which, for any compressed format, are not the same number.
+	Bar *pb.ProgressBar
+}
+
+// newArchiveBar creates (but does not start) a progress bar sized to
+// total. A total of 0 means the size walk didn't complete in time;
+// the bar still works, just with an indeterminate maximum.
+func newArchiveBar(total uint64) *pb.ProgressBar {
+	return pb.New64(int64(total)).SetUnits(pb.U_BYTES)
+}
+
+// barWriter adapts a *pb.ProgressBar to io.Writer, so it can be teed
+// into an archive-producing function's pre-compression byte stream
+// instead of wrapping the (possibly compressed) disk-bound reader.
+type barWriter struct{ bar *pb.ProgressBar }
+
+func (bw barWriter) Write(p []byte) (int, error) {
+	bw.bar.Add(len(p))
+	return len(p), nil
 }
 
 type getWriter struct {
@@ -129,6 +327,13 @@ type getWriter struct {
 
 	Archive     bool
 	Compression int
+	Size        uint64
+	Ext         string
+
+	// Bar is already tracking real progress (Run wires it into the
+	// archive-producing function itself, as a barWriter) and just
+	// needs its output and lifecycle set up here.
+	Bar *pb.ProgressBar
 }
 
 func (gw *getWriter) Write(r io.Reader, fpath string) error {
@@ -139,15 +344,13 @@ func (gw *getWriter) Write(r io.Reader, fpath string) error {
 }
 
 func (gw *getWriter) writeArchive(r io.Reader, fpath string) error {
-	// adjust file name if tar
+	// adjust file name to match the archive format in use
 	if gw.Archive {
-		if !strings.HasSuffix(fpath, ".tar") && !strings.HasSuffix(fpath, ".tar.gz") {
-			fpath += ".tar"
+		if gw.Ext != "" && !strings.HasSuffix(fpath, gw.Ext) {
+			fpath += gw.Ext
 		}
-	}
-
-	// adjust file name if gz
-	if gw.Compression != gzip.NoCompression {
+	} else if gw.Compression != gzip.NoCompression {
+		// the raw '-C'-only gzip path: no archive format, just ".gz"
 		if !strings.HasSuffix(fpath, ".gz") {
 			fpath += ".gz"
 		}
@@ -161,22 +364,22 @@ func (gw *getWriter) writeArchive(r io.Reader, fpath string) error {
 	defer file.Close()
 
 	fmt.Fprintf(gw.Out, "Saving archive to %s\n", fpath)
-	bar, barR := progressBarForReader(gw.Err, r)
-	bar.Start()
-	defer bar.Finish()
+	gw.Bar.Output = gw.Err
+	gw.Bar.Start()
+	defer gw.Bar.Finish()
 
-	_, err = io.Copy(file, barR)
+	_, err = io.Copy(file, r)
 	return err
 }
 
 func (gw *getWriter) writeExtracted(r io.Reader, fpath string) error {
 	fmt.Fprintf(gw.Out, "Saving file(s) to %s\n", fpath)
-	bar, barR := progressBarForReader(gw.Err, r)
-	bar.Start()
-	defer bar.Finish()
+	gw.Bar.Output = gw.Err
+	gw.Bar.Start()
+	defer gw.Bar.Finish()
 
 	extractor := &tar.Extractor{fpath}
-	return extractor.Extract(barR)
+	return extractor.Extract(r)
 }
 
 func getCompressOptions(req cmds.Request) (int, error) {
@@ -193,35 +396,77 @@ func getCompressOptions(req cmds.Request) (int, error) {
 	return gzip.NoCompression, nil
 }
 
-func get(ctx context.Context, node *core.IpfsNode, p path.Path, compression int) (io.Reader, error) {
-	dn, err := core.Resolve(ctx, node, p)
-	if err != nil {
-		return nil, err
+// getParallelOption reads the `--parallel`/`-j` option: 0 (the
+// default) means "auto" (GOMAXPROCS workers), 1 forces the original
+// single-goroutine compression path, and negative values are
+// rejected.
+func getParallelOption(req cmds.Request) (int, error) {
+	workers, _, _ := req.Option("parallel").Int()
+	if workers < 0 {
+		return 0, ErrInvalidParallelism
 	}
-
-	return utar.DagArchive(ctx, dn, p.String(), node.DAG, compression)
+	return workers, nil
 }
 
-// getZip is equivalent to `ipfs getdag $hash | gzip`
-func getZip(ctx context.Context, node *core.IpfsNode, p path.Path, compression int) (io.Reader, error) {
-	dagnode, err := core.Resolve(ctx, node, p)
+// getArchiveFormat resolves the `--format` option (falling back to
+// the plain tar/tar.gz pairing `--archive`/`--compress` have always
+// produced) to a registered utar.ArchiveWriter.
+func getArchiveFormat(req cmds.Request) (utar.ArchiveWriter, error) {
+	cmplvl, err := getCompressOptions(req)
+	if err != nil {
+		return nil, err
+	}
+	workers, err := getParallelOption(req)
 	if err != nil {
 		return nil, err
 	}
 
-	reader, err := uio.NewDagReader(ctx, dagnode, node.DAG)
+	if name, given, _ := req.Option("format").String(); given {
+		return utar.FormatByName(name, cmplvl, workers)
+	}
+
+	if cmplvl != gzip.NoCompression {
+		return utar.FormatByName("tar.gz", cmplvl, workers)
+	}
+	return utar.FormatByName("tar", 0, workers)
+}
+
+// get archives dn in the given format. If progress is non-nil, every
+// byte of the uncompressed archive stream (for a tar-framed format,
+// headers and padding included) is also written to it as it's
+// produced, before format's compression (if any), so a caller tracking
+// progress against the uncompressed archive size (see boundedArchiveSize)
+// sees real progress even when format compresses its output.
+func get(ctx context.Context, node *core.IpfsNode, dn *dag.Node, p path.Path, format utar.ArchiveWriter, progress io.Writer) (io.Reader, error) {
+	return utar.DagArchive(ctx, dn, p.String(), node.DAG, format, progress)
+}
+
+// getZip is equivalent to `ipfs getdag $hash | gzip`. workers controls
+// the degree of parallelism in the underlying gzip compression (0 =
+// auto, 1 = serial); see thirdparty/pgzip. If progress is non-nil,
+// every uncompressed byte read out of the DAG is also written to it as
+// it's produced, before gzip compression, so a caller tracking
+// progress against the uncompressed DAG size (see boundedDagSize) sees
+// real progress instead of post-compression bytes.
+func getZip(ctx context.Context, node *core.IpfsNode, dn *dag.Node, compression, workers int, progress io.Writer) (io.Reader, error) {
+	reader, err := uio.NewDagReader(ctx, dn, node.DAG)
 	if err != nil {
 		return nil, err
 	}
 
 	pr, pw := io.Pipe()
-	gw, err := gzip.NewWriterLevel(pw, compression)
+	var gw io.WriteCloser
+	if workers == 1 {
+		gw, err = gzip.NewWriterLevel(pw, compression)
+	} else {
+		gw, err = pgzip.NewWriterLevel(pw, compression, workers, pgzip.DefaultBlockSize)
+	}
 	if err != nil {
 		return nil, err
 	}
 	bufin := bufio.NewReader(reader)
 	go func() {
-		_, err := bufin.WriteTo(gw)
+		_, err := io.Copy(teeWriter(gw, progress), bufin)
 		if err != nil {
 			log.Error("Fail to compress the stream")
 		}
@@ -230,4 +475,127 @@ func getZip(ctx context.Context, node *core.IpfsNode, p path.Path, compression i
 	}()
 
 	return pr, nil
-}
\ No newline at end of file
+}
+
+// teeWriter returns dst unchanged if progress is nil; otherwise it
+// returns a writer that duplicates every write to both.
+func teeWriter(dst, progress io.Writer) io.Writer {
+	if progress == nil {
+		return dst
+	}
+	return io.MultiWriter(dst, progress)
+}
+
+// boundedDagSize walks the DAG rooted at nd, within sizeWalkTimeout,
+// summing the logical UnixFS size of every file reachable from it. It
+// returns 0 if the walk errors or doesn't finish in time, so callers
+// can fall back to an indeterminate progress bar.
+func boundedDagSize(ctx context.Context, nd *dag.Node, ds dag.DAGService) uint64 {
+	wctx, cancel := context.WithTimeout(ctx, sizeWalkTimeout)
+	defer cancel()
+
+	total, err := dagSize(wctx, nd, ds)
+	if err != nil {
+		return 0
+	}
+	return total
+}
+
+// boundedArchiveSize is like boundedDagSize, but accounts for the
+// 512-byte tar header each file and directory contributes, payload
+// padding, and the two zero blocks tar.Writer.Close appends at the end
+// of every archive - i.e. the byte count a tar rendering of nd
+// produces, matching what DagArchive actually tees into progress, as
+// long as every entry needs a single header block (extended header
+// blocks that archive/tar adds for long or non-ASCII names are not
+// counted).
+func boundedArchiveSize(ctx context.Context, nd *dag.Node, ds dag.DAGService) uint64 {
+	wctx, cancel := context.WithTimeout(ctx, sizeWalkTimeout)
+	defer cancel()
+
+	total, err := archiveSize(wctx, nd, ds)
+	if err != nil {
+		return 0
+	}
+	return total + tarEndOfArchiveSize
+}
+
+// dagSize returns the sum of the logical (UnixFS) sizes of every file
+// reachable from nd. Directories contribute nothing themselves; their
+// children are walked instead.
+func dagSize(ctx context.Context, nd *dag.Node, ds dag.DAGService) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	if pbn.GetType() != ftpb.Data_Directory {
+		return pbn.GetFilesize(), nil
+	}
+
+	var total uint64
+	for _, l := range nd.Links {
+		child, err := l.GetNode(ctx, ds)
+		if err != nil {
+			return 0, err
+		}
+		sz, err := dagSize(ctx, child, ds)
+		if err != nil {
+			return 0, err
+		}
+		total += sz
+	}
+	return total, nil
+}
+
+// archiveSize is like dagSize, but returns the number of bytes a tar
+// rendering of nd occupies: one 512-byte header per file (plus its
+// payload, rounded up to the next block boundary) and per directory
+// (writeDagToTar/writeDagToTarCDC both emit a header for every
+// directory too, including nd itself). It does not include the fixed
+// end-of-archive padding tar.Writer.Close appends; add
+// tarEndOfArchiveSize for that once, at the top of the walk (see
+// boundedArchiveSize).
+func archiveSize(ctx context.Context, nd *dag.Node, ds dag.DAGService) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return 0, err
+	}
+
+	if pbn.GetType() != ftpb.Data_Directory {
+		return tarEntrySize(pbn.GetFilesize()), nil
+	}
+
+	total := uint64(tarBlockSize) // this directory's own header
+	for _, l := range nd.Links {
+		child, err := l.GetNode(ctx, ds)
+		if err != nil {
+			return 0, err
+		}
+		sz, err := archiveSize(ctx, child, ds)
+		if err != nil {
+			return 0, err
+		}
+		total += sz
+	}
+	return total, nil
+}
+
+// tarEntrySize returns the number of bytes a single file of size sz
+// occupies in a tar stream: one header block plus the payload rounded
+// up to the next block boundary.
+func tarEntrySize(sz uint64) uint64 {
+	padded := sz
+	if r := padded % tarBlockSize; r != 0 {
+		padded += tarBlockSize - r
+	}
+	return tarBlockSize + padded
+}
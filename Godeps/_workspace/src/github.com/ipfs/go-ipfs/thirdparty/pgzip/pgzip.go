@@ -0,0 +1,184 @@
+// Package pgzip implements a parallel, block-based gzip writer modeled
+// on klauspost/pgzip: input is split into fixed-size blocks, each
+// block is compressed independently by a worker pool, and the
+// compressed blocks are written out in input order as successive gzip
+// members. The result is a single, standard gzip stream - gzip.Reader
+// (and every other conforming decompressor) concatenates members
+// transparently, so nothing on the reading side needs to know the
+// stream was produced in parallel.
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+)
+
+// DefaultBlockSize is the amount of input compressed as a single gzip
+// member when no explicit block size is requested.
+const DefaultBlockSize = 1 << 20 // 1 MiB
+
+// result carries a single compressed block back to the writer loop,
+// in the order its input was seen.
+type result struct {
+	data []byte
+	err  error
+}
+
+// Writer is a parallel gzip.Writer replacement: it implements
+// io.WriteCloser and produces byte-for-byte valid gzip output, but
+// spreads compression work for large inputs across GOMAXPROCS (or a
+// caller-chosen number of) goroutines.
+type Writer struct {
+	out       io.Writer
+	level     int
+	blockSize int
+	sem       chan struct{}
+
+	buf   bytes.Buffer
+	order chan chan result
+
+	writeWG  sync.WaitGroup
+	writeErr error
+
+	// dispatched tracks whether any block, even an empty one, has been
+	// handed to the worker pool yet - so Close can tell "nothing was
+	// ever written" from "the last block landed exactly on a boundary"
+	// and still emit a valid (if empty) gzip stream for the former.
+	dispatched bool
+
+	closed bool
+}
+
+// NewWriterLevel returns a Writer that writes compressed data to w at
+// the given level, using workers goroutines to compress concurrently.
+// workers <= 0 means runtime.GOMAXPROCS(0); workers == 1 degenerates
+// to fully serial compression (one block the size of the whole
+// stream would; here we still block-split, but only one block is ever
+// in flight). blockSize <= 0 uses DefaultBlockSize.
+func NewWriterLevel(w io.Writer, level, workers, blockSize int) (*Writer, error) {
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+
+	pw := &Writer{
+		out:       w,
+		level:     level,
+		blockSize: blockSize,
+		sem:       make(chan struct{}, workers),
+		order:     make(chan chan result, workers*2),
+	}
+
+	pw.writeWG.Add(1)
+	go pw.writeLoop()
+
+	return pw, nil
+}
+
+// Write buffers p, flushing full blocks to the worker pool as they
+// fill up. It never returns a short write.
+func (w *Writer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		room := w.blockSize - w.buf.Len()
+		if room > len(p) {
+			room = len(p)
+		}
+		w.buf.Write(p[:room])
+		p = p[room:]
+		if w.buf.Len() >= w.blockSize {
+			w.dispatch(w.buf.Bytes())
+			w.buf.Reset()
+		}
+	}
+	return n, nil
+}
+
+// dispatch hands block off to a worker, blocking only while the
+// reordering backlog (order) is full or all workers are busy - i.e.
+// genuine backpressure, not a serialization point.
+func (w *Writer) dispatch(block []byte) {
+	w.dispatched = true
+
+	// own copy: block aliases w.buf's backing array, which Write reuses.
+	own := make([]byte, len(block))
+	copy(own, block)
+
+	rc := make(chan result, 1)
+	w.order <- rc
+
+	w.sem <- struct{}{}
+	go func() {
+		defer func() { <-w.sem }()
+		rc <- compressBlock(own, w.level)
+	}()
+}
+
+func compressBlock(data []byte, level int) result {
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return result{err: err}
+	}
+	if _, err := gw.Write(data); err != nil {
+		return result{err: err}
+	}
+	if err := gw.Close(); err != nil {
+		return result{err: err}
+	}
+	return result{data: buf.Bytes()}
+}
+
+// writeLoop drains completed blocks from order, strictly in the order
+// they were dispatched, and writes their compressed bytes to out.
+func (w *Writer) writeLoop() {
+	defer w.writeWG.Done()
+
+	for rc := range w.order {
+		res := <-rc
+		if res.err != nil {
+			if w.writeErr == nil {
+				w.writeErr = res.err
+			}
+			continue
+		}
+		if w.writeErr != nil {
+			continue
+		}
+		if _, err := w.out.Write(res.data); err != nil {
+			w.writeErr = err
+		}
+	}
+}
+
+// Close flushes any buffered-but-not-yet-full block and waits for all
+// outstanding blocks to be written, in order, to the underlying
+// writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return w.writeErr
+	}
+	w.closed = true
+
+	// Dispatch the final partial block, or - if nothing was ever
+	// written - an empty block, so the output is always at least a
+	// valid empty gzip stream rather than zero bytes.
+	if w.buf.Len() > 0 || !w.dispatched {
+		w.dispatch(w.buf.Bytes())
+		w.buf.Reset()
+	}
+
+	close(w.order)
+	w.writeWG.Wait()
+
+	return w.writeErr
+}
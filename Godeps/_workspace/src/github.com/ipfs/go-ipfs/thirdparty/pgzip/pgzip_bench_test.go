@@ -0,0 +1,60 @@
+package pgzip
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// benchSize approximates the multi-GB UnixFS files this package is
+// meant to help with, scaled down so the benchmark still finishes in
+// CI; throughput scales with GOMAXPROCS regardless of absolute size.
+const benchSize = 256 << 20 // 256 MiB
+
+func benchData(b *testing.B) []byte {
+	b.Helper()
+	data := make([]byte, benchSize)
+	// random data so gzip can't shortcut by exploiting long runs; it
+	// is essentially incompressible, so this measures raw throughput.
+	rand.New(rand.NewSource(1)).Read(data)
+	return data
+}
+
+func BenchmarkSerialGzip(b *testing.B) {
+	data := benchData(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		gw, err := gzip.NewWriterLevel(ioutil.Discard, gzip.DefaultCompression)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := gw.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParallelGzip(b *testing.B) {
+	data := benchData(b)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		pw, err := NewWriterLevel(ioutil.Discard, gzip.DefaultCompression, 0, DefaultBlockSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := pw.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := pw.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package pgzip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+// TestRoundTrip checks that decompressing Writer's output with the
+// standard library's gzip.Reader always reproduces the input exactly,
+// across sizes that land on, just under, and well past a single
+// block boundary - including zero bytes, where Close must still emit
+// a valid (empty) gzip stream rather than nothing at all.
+func TestRoundTrip(t *testing.T) {
+	sizes := []int{
+		0,
+		1,
+		DefaultBlockSize - 1,
+		DefaultBlockSize,
+		DefaultBlockSize + 1,
+		3*DefaultBlockSize + 17,
+	}
+
+	for _, workers := range []int{1, 0, 4} {
+		for _, size := range sizes {
+			data := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(data)
+
+			var out bytes.Buffer
+			w, err := NewWriterLevel(&out, gzip.DefaultCompression, workers, DefaultBlockSize)
+			if err != nil {
+				t.Fatalf("workers=%d size=%d: NewWriterLevel: %v", workers, size, err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatalf("workers=%d size=%d: Write: %v", workers, size, err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("workers=%d size=%d: Close: %v", workers, size, err)
+			}
+
+			gr, err := gzip.NewReader(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatalf("workers=%d size=%d: gzip.NewReader: %v", workers, size, err)
+			}
+			got, err := ioutil.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("workers=%d size=%d: ReadAll: %v", workers, size, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("workers=%d size=%d: round-trip mismatch: got %d bytes, want %d", workers, size, len(got), len(data))
+			}
+		}
+	}
+}
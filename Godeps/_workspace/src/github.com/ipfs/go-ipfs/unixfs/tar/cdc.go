@@ -0,0 +1,305 @@
+package tar
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	gopath "path"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+	uio "github.com/ipfs/go-ipfs/unixfs/io"
+	ftpb "github.com/ipfs/go-ipfs/unixfs/pb"
+)
+
+const (
+	// cdcWindowSize is the rolling hash's sliding window.
+	cdcWindowSize = 64
+
+	// DefaultCDCAvg is the default target average chunk size.
+	DefaultCDCAvg = 1 << 20 // 1 MiB
+
+	// DefaultCDCMin and DefaultCDCMax bound every cut regardless of
+	// what the rolling hash says.
+	DefaultCDCMin = 512 << 10 // 512 KiB
+	DefaultCDCMax = 8 << 20   // 8 MiB
+)
+
+// ChunkRange locates one content-defined chunk within the archive's
+// (pre-compression) tar byte stream.
+type ChunkRange struct {
+	Offset int64 `json:"offset"`
+	Len    int64 `json:"len"`
+}
+
+// CDCManifest maps a chunk's content digest (hex sha256, "sha256:"
+// prefixed) to every range it occupies in the archive. Two `ipfs get`
+// runs over related trees that happen to share file content will
+// produce entries with matching keys - even though the raw UnixFS DAG
+// chunking of those files may differ - because cuts are made by
+// content, not by DAG block boundaries.
+type CDCManifest struct {
+	Chunks map[string][]ChunkRange `json:"chunks"`
+}
+
+// CDCResult is sent once, after the archive goroutine started by
+// DagArchiveCDC finishes, carrying either the completed manifest or
+// the error that aborted the write.
+type CDCResult struct {
+	Manifest *CDCManifest
+	Err      error
+}
+
+// DagArchiveCDC is like DagArchive, but instead of copying each
+// file's UnixFS blocks straight into the archive, it re-chunks file
+// content with a rolling-hash (buzhash) splitter first. Chunk
+// boundaries are therefore a function of content, not of how the
+// file happened to be DAG-chunked on import, so unrelated `ipfs get`
+// runs of overlapping data tend to agree on where chunks start and
+// end - which is what makes an rsync/casync-style delta transfer over
+// the archive's chunks useful in the first place.
+//
+// The returned channel carries the resulting CDCManifest once the
+// archive has been fully written (or the error that stopped it);
+// callers should read the archive to completion before receiving
+// from it.
+//
+// If progress is non-nil, every byte of the uncompressed tar stream
+// (headers, padding and end-of-archive blocks included) is also
+// written to it as it's produced, before format's compression, so a
+// caller computing the tar stream's size ahead of time can track real
+// progress against it.
+func DagArchiveCDC(ctx context.Context, nd *dag.Node, root string, ds dag.DAGService, format ArchiveWriter, avg int64, progress io.Writer) (io.Reader, <-chan CDCResult, error) {
+	if !SupportsCDC(format) {
+		return nil, nil, fmt.Errorf("--cdc is not supported with the %q format", format.Extension())
+	}
+	_, root = gopath.Split(root)
+
+	pr, pw := io.Pipe()
+	sink, err := format.NewWriter(pw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan CDCResult, 1)
+
+	go func() {
+		cw := &countingWriter{w: sink}
+		tw := tar.NewWriter(teeWriter(cw, progress))
+		manifest := &CDCManifest{Chunks: map[string][]ChunkRange{}}
+
+		err := writeDagToTarCDC(ctx, tw, cw, nd, root, ds, avg, manifest)
+		if err == nil {
+			err = tw.Close()
+		}
+		if err == nil {
+			err = sink.Close()
+		}
+		if err != nil {
+			pw.CloseWithError(err)
+			done <- CDCResult{Err: err}
+			return
+		}
+		pw.Close()
+		done <- CDCResult{Manifest: manifest}
+	}()
+
+	return pr, done, nil
+}
+
+// writeDagToTarCDC is the CDC analogue of writeDagToTar. avg is the
+// target average chunk size passed to a fresh cdcSplitter constructed
+// for each file: chunk boundaries must depend only on that file's own
+// content, never on whatever file preceded it in the walk, or two
+// unrelated `ipfs get` runs over the same file in different trees
+// would disagree on where it cuts.
+func writeDagToTarCDC(ctx context.Context, tw *tar.Writer, cw *countingWriter, nd *dag.Node, name string, ds dag.DAGService, avg int64, manifest *CDCManifest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return err
+	}
+
+	if pbn.GetType() == ftpb.Data_Directory {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0777,
+		}); err != nil {
+			return err
+		}
+		for _, l := range nd.Links {
+			child, err := l.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			if err := writeDagToTarCDC(ctx, tw, cw, child, gopath.Join(name, l.Name), ds, avg, manifest); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, ds)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Size: int64(pbn.GetFilesize()),
+		Mode: 0644,
+	}); err != nil {
+		return err
+	}
+
+	splitter := newCDCSplitter(avg, DefaultCDCMin, DefaultCDCMax)
+
+	return copyCDC(tw, cw, r, splitter, manifest)
+}
+
+// copyCDC copies r to tw exactly as io.Copy would, except it flushes
+// at content-defined boundaries instead of arbitrary buffer sizes,
+// recording each chunk's digest and (pre-compression) archive offset
+// in manifest as it goes.
+func copyCDC(tw *tar.Writer, cw *countingWriter, r io.Reader, s *cdcSplitter, manifest *CDCManifest) error {
+	br := bufio.NewReader(r)
+	var chunk bytes.Buffer
+	chunkStart := cw.off
+
+	flush := func() error {
+		if chunk.Len() == 0 {
+			return nil
+		}
+		data := chunk.Bytes()
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+		manifest.Chunks[digest] = append(manifest.Chunks[digest], ChunkRange{
+			Offset: chunkStart,
+			Len:    int64(len(data)),
+		})
+
+		chunk.Reset()
+		chunkStart = cw.off
+		return nil
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk.WriteByte(b)
+		if s.roll(b) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
+
+// buzhashTable is a fixed table of per-byte-value random 64-bit words
+// used by the rolling hash. It's fixed (not seeded per process) on
+// purpose: two separate `ipfs get --cdc` invocations need to agree on
+// where chunk boundaries fall for identical content to be useful.
+var buzhashTable = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		t[i] = x
+	}
+	return t
+}()
+
+// cdcSplitter is a buzhash-based content-defined chunker: it cuts a
+// chunk whenever the low bits of the rolling hash over the last
+// cdcWindowSize bytes selected by a fixed mask (sized from the target
+// average avg, see maskBits) are all zero, bounded to [min, max].
+type cdcSplitter struct {
+	window [cdcWindowSize]byte
+	pos    int
+	filled int
+	hash   uint64
+
+	mask     uint64
+	min, max int64
+	since    int64 // bytes seen since the last cut
+}
+
+func newCDCSplitter(avg, min, max int64) *cdcSplitter {
+	if avg <= 0 {
+		avg = DefaultCDCAvg
+	}
+	if min <= 0 {
+		min = DefaultCDCMin
+	}
+	if max <= 0 {
+		max = DefaultCDCMax
+	}
+	return &cdcSplitter{
+		mask: 1<<uint(maskBits(avg)) - 1,
+		min:  min,
+		max:  max,
+	}
+}
+
+// maskBits returns the number of low bits of the rolling hash that
+// must be zero for a cut, i.e. log2(avg) rounded up to the next
+// integer.
+func maskBits(avg int64) int {
+	n := 0
+	for int64(1)<<uint(n) < avg {
+		n++
+	}
+	return n
+}
+
+// roll feeds one more byte through the rolling hash and reports
+// whether the splitter has reached a cut point.
+func (s *cdcSplitter) roll(b byte) bool {
+	var out byte
+	if s.filled == cdcWindowSize {
+		out = s.window[s.pos]
+	} else {
+		s.filled++
+	}
+	s.window[s.pos] = b
+	s.pos = (s.pos + 1) % cdcWindowSize
+
+	s.hash = bits.RotateLeft64(s.hash, 1) ^ bits.RotateLeft64(buzhashTable[out], cdcWindowSize) ^ buzhashTable[b]
+	s.since++
+
+	switch {
+	case s.since < s.min:
+		return false
+	case s.since >= s.max:
+		s.since = 0
+		return true
+	case s.hash&s.mask == 0:
+		s.since = 0
+		return true
+	default:
+		return false
+	}
+}
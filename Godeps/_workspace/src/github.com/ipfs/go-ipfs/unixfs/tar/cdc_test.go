@@ -0,0 +1,193 @@
+package tar
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	mdtest "github.com/ipfs/go-ipfs/merkledag/test"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+)
+
+// TestCDCSplitterBounds checks that the splitter never cuts below
+// min, never runs past max, and - fed the same input twice - always
+// cuts at exactly the same points (a prerequisite for cross-run
+// dedup).
+func TestCDCSplitterBounds(t *testing.T) {
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	split := func() []int64 {
+		s := newCDCSplitter(256<<10, 64<<10, 512<<10)
+		var lens []int64
+		var since int64
+		for _, b := range data {
+			since++
+			if s.roll(b) {
+				lens = append(lens, since)
+				since = 0
+			}
+		}
+		if since > 0 {
+			lens = append(lens, since)
+		}
+		return lens
+	}
+
+	a := split()
+	b := split()
+	if len(a) != len(b) {
+		t.Fatalf("non-deterministic cut count: %d vs %d", len(a), len(b))
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("non-deterministic cut at chunk %d: %d vs %d", i, a[i], b[i])
+		}
+		if i < len(a)-1 {
+			if a[i] < 64<<10 {
+				t.Errorf("chunk %d shorter than min: %d", i, a[i])
+			}
+			if a[i] > 512<<10 {
+				t.Errorf("chunk %d longer than max: %d", i, a[i])
+			}
+		}
+	}
+}
+
+// TestCDCRoundTrip archives a small fixture tree with --cdc chunking
+// and checks that every manifest entry's recorded [offset, len] in
+// the (uncompressed) archive stream really contains bytes hashing to
+// that entry's key.
+func TestCDCRoundTrip(t *testing.T) {
+	root, ds := buildFixtureDag(t)
+
+	r, done, err := DagArchiveCDC(context.Background(), root, "root", ds, tarFormat{}, DefaultCDCAvg, nil)
+	if err != nil {
+		t.Fatalf("DagArchiveCDC: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	result := <-done
+	if result.Err != nil {
+		t.Fatalf("archive goroutine: %v", result.Err)
+	}
+
+	if len(result.Manifest.Chunks) == 0 {
+		t.Fatal("manifest has no chunks")
+	}
+	for digest, ranges := range result.Manifest.Chunks {
+		for _, rng := range ranges {
+			if rng.Offset < 0 || rng.Offset+rng.Len > int64(len(data)) {
+				t.Fatalf("chunk %s: range %+v out of bounds (archive is %d bytes)", digest, rng, len(data))
+			}
+			chunk := data[rng.Offset : rng.Offset+rng.Len]
+			sum := sha256.Sum256(chunk)
+			got := "sha256:" + hex.EncodeToString(sum[:])
+			if got != digest {
+				t.Errorf("chunk at %+v hashes to %s, want %s", rng, got, digest)
+			}
+		}
+	}
+}
+
+// TestCDCSplitterResetsPerFile checks that a file's CDC chunk
+// boundaries depend only on its own content, not on whatever file
+// preceded it in the DAG walk - the whole premise of comparing chunks
+// across unrelated `ipfs get` runs breaks if a shared splitter carries
+// state from one file into the next.
+func TestCDCSplitterResetsPerFile(t *testing.T) {
+	shared := make([]byte, 3<<20)
+	rand.New(rand.NewSource(2)).Read(shared)
+	other := make([]byte, 2<<20)
+	rand.New(rand.NewSource(3)).Read(other)
+
+	alone := twoFileDag(t, nil, shared)
+	preceded := twoFileDag(t, other, shared)
+
+	aloneDigests := cdcChunkDigests(t, alone.root, alone.ds)
+	precededDigests := cdcChunkDigests(t, preceded.root, preceded.ds)
+
+	for digest := range aloneDigests {
+		if !precededDigests[digest] {
+			t.Errorf("shared file chunk %s seen when archived alone, but not when preceded by another file - chunking depends on walk order", digest)
+		}
+	}
+}
+
+// twoFileDag builds a directory with one or two regular files: a
+// "before" file (skipped if nil) followed by a "shared" file, in that
+// link order, so shared's chunking can be compared with and without a
+// preceding sibling.
+type twoFileFixture struct {
+	root *dag.Node
+	ds   dag.DAGService
+}
+
+func twoFileDag(t *testing.T, before, shared []byte) twoFileFixture {
+	t.Helper()
+	ds := mdtest.Mock()
+
+	root := &dag.Node{Data: ft.FolderPBData()}
+	if before != nil {
+		beforeNode := &dag.Node{Data: ft.FilePBData(before, uint64(len(before)))}
+		if _, err := ds.Add(beforeNode); err != nil {
+			t.Fatalf("add before node: %v", err)
+		}
+		if err := root.AddNodeLink("before", beforeNode); err != nil {
+			t.Fatalf("link before node: %v", err)
+		}
+	}
+
+	sharedNode := &dag.Node{Data: ft.FilePBData(shared, uint64(len(shared)))}
+	if _, err := ds.Add(sharedNode); err != nil {
+		t.Fatalf("add shared node: %v", err)
+	}
+	if err := root.AddNodeLink("shared", sharedNode); err != nil {
+		t.Fatalf("link shared node: %v", err)
+	}
+
+	if _, err := ds.Add(root); err != nil {
+		t.Fatalf("add root node: %v", err)
+	}
+	return twoFileFixture{root: root, ds: ds}
+}
+
+// cdcChunkDigests archives root with --cdc and returns the set of
+// chunk digests the manifest recorded.
+func cdcChunkDigests(t *testing.T, root *dag.Node, ds dag.DAGService) map[string]bool {
+	t.Helper()
+	r, done, err := DagArchiveCDC(context.Background(), root, "root", ds, tarFormat{}, DefaultCDCAvg, nil)
+	if err != nil {
+		t.Fatalf("DagArchiveCDC: %v", err)
+	}
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+	result := <-done
+	if result.Err != nil {
+		t.Fatalf("archive goroutine: %v", result.Err)
+	}
+
+	digests := make(map[string]bool, len(result.Manifest.Chunks))
+	for digest := range result.Manifest.Chunks {
+		digests[digest] = true
+	}
+	return digests
+}
+
+// TestCDCRejectsZip checks that zip - which can't consume a flat tar
+// byte stream - is rejected up front instead of failing mid-archive.
+func TestCDCRejectsZip(t *testing.T) {
+	root, ds := buildFixtureDag(t)
+
+	if _, _, err := DagArchiveCDC(context.Background(), root, "root", ds, zipFormat{}, DefaultCDCAvg, nil); err == nil {
+		t.Fatal("expected an error archiving --cdc with --format=zip, got nil")
+	}
+}
@@ -0,0 +1,45 @@
+package tar
+
+import (
+	"testing"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	mdtest "github.com/ipfs/go-ipfs/merkledag/test"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+)
+
+// helloContent is the content of the one regular file in
+// buildFixtureDag's tree.
+const helloContent = "hello world\n"
+
+// buildFixtureDag builds a small in-memory UnixFS tree - a directory
+// containing one regular file and one empty subdirectory - and
+// returns its root node alongside the DAGService it was added to, for
+// format round-trip tests.
+func buildFixtureDag(t *testing.T) (*dag.Node, dag.DAGService) {
+	t.Helper()
+	ds := mdtest.Mock()
+
+	file := &dag.Node{Data: ft.FilePBData([]byte(helloContent), uint64(len(helloContent)))}
+	if _, err := ds.Add(file); err != nil {
+		t.Fatalf("add file node: %v", err)
+	}
+
+	emptyDir := &dag.Node{Data: ft.FolderPBData()}
+	if _, err := ds.Add(emptyDir); err != nil {
+		t.Fatalf("add empty dir node: %v", err)
+	}
+
+	root := &dag.Node{Data: ft.FolderPBData()}
+	if err := root.AddNodeLink("hello.txt", file); err != nil {
+		t.Fatalf("link file node: %v", err)
+	}
+	if err := root.AddNodeLink("empty", emptyDir); err != nil {
+		t.Fatalf("link empty dir node: %v", err)
+	}
+	if _, err := ds.Add(root); err != nil {
+		t.Fatalf("add root node: %v", err)
+	}
+
+	return root, ds
+}
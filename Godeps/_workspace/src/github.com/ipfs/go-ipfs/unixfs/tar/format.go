@@ -0,0 +1,127 @@
+package tar
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	xz "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/ulikunitz/xz"
+	zstd "github.com/ipfs/go-ipfs/Godeps/_workspace/src/github.com/klauspost/compress/zstd"
+
+	"github.com/ipfs/go-ipfs/thirdparty/pgzip"
+)
+
+// ArchiveWriter wraps a single archive/compression format that
+// DagArchive can render a UnixFS tree into. Implementations that need
+// to lay out entries themselves instead of wrapping a flat tar stream
+// (e.g. zip) additionally implement dagArchiver.
+type ArchiveWriter interface {
+	// NewWriter wraps w, returning a WriteCloser that frames or
+	// compresses whatever is written to it in this format. Closing
+	// the returned writer flushes and finalizes the format, but does
+	// not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+
+	// Extension is the filename suffix get should append to the
+	// output path for this format, e.g. ".tar.gz".
+	Extension() string
+
+	// ContentType is the MIME type of the resulting stream.
+	ContentType() string
+}
+
+var formats = map[string]ArchiveWriter{
+	"tar":     tarFormat{},
+	"tar.gz":  gzipFormat{level: gzip.DefaultCompression},
+	"tar.xz":  xzFormat{},
+	"tar.zst": zstdFormat{},
+	"zip":     zipFormat{},
+}
+
+// Format looks up a registered ArchiveWriter by name (as accepted by
+// the `--format` option of `ipfs get`).
+func Format(name string) (ArchiveWriter, bool) {
+	f, ok := formats[name]
+	return f, ok
+}
+
+// FormatByName is like Format, but for the gzip-based "tar.gz" format
+// applies level as the compression level (gzip.DefaultCompression if
+// level is 0) and workers as the degree of parallelism (workers <= 0
+// means auto/GOMAXPROCS, workers == 1 means the original serial
+// compress/gzip path). Both are used when a caller already knows the
+// desired settings, e.g. from `ipfs get`'s `-l`/`-j` options.
+func FormatByName(name string, level, workers int) (ArchiveWriter, error) {
+	f, ok := Format(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown archive format %q", name)
+	}
+	if gz, ok := f.(gzipFormat); ok {
+		if level != 0 {
+			gz.level = level
+		}
+		gz.workers = workers
+		return gz, nil
+	}
+	return f, nil
+}
+
+// nopWriteCloser adapts an io.Writer that needs no finalization (e.g.
+// the identity "tar" format) to io.WriteCloser.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// tarFormat is the plain, uncompressed tar container.
+type tarFormat struct{}
+
+func (tarFormat) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (tarFormat) Extension() string   { return ".tar" }
+func (tarFormat) ContentType() string { return "application/x-tar" }
+
+// gzipFormat is a gzip-compressed tar container; this is the format
+// `ipfs get --archive --compress` has always produced. When workers
+// != 1, compression runs in parallel via pgzip.
+type gzipFormat struct {
+	level   int
+	workers int
+}
+
+func (f gzipFormat) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	if f.workers == 1 {
+		return gzip.NewWriterLevel(w, f.level)
+	}
+	return pgzip.NewWriterLevel(w, f.level, f.workers, pgzip.DefaultBlockSize)
+}
+
+func (gzipFormat) Extension() string   { return ".tar.gz" }
+func (gzipFormat) ContentType() string { return "application/gzip" }
+
+// xzFormat is an xz-compressed tar container.
+type xzFormat struct{}
+
+func (xzFormat) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	xw, err := xz.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xzFormat) Extension() string   { return ".tar.xz" }
+func (xzFormat) ContentType() string { return "application/x-xz" }
+
+// zstdFormat is a zstd-compressed tar container.
+type zstdFormat struct{}
+
+func (zstdFormat) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w)
+}
+
+func (zstdFormat) Extension() string   { return ".tar.zst" }
+func (zstdFormat) ContentType() string { return "application/zstd" }
@@ -0,0 +1,319 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	gopath "path"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+	uio "github.com/ipfs/go-ipfs/unixfs/io"
+	ftpb "github.com/ipfs/go-ipfs/unixfs/pb"
+)
+
+// DefaultChunkSize is the chunk size DagArchiveSeekable splits file
+// content into when none is given.
+const DefaultChunkSize = 4 << 20 // 4 MiB
+
+// footerSize is the fixed length of the trailing gzip member that
+// locates the TOC, matching the eStargz footer convention: a client
+// that fetches only the last footerSize bytes of the archive can
+// always find the TOC without knowing the archive's length up front.
+const footerSize = 47
+
+// TOCEntry describes one chunk of one file in a seekable archive.
+type TOCEntry struct {
+	Name        string `json:"name"`
+	Offset      int64  `json:"offset"`      // compressed offset of this chunk's gzip member
+	ChunkOffset int64  `json:"chunkOffset"` // logical offset within the file
+	ChunkSize   int64  `json:"chunkSize"`
+	ChunkDigest string `json:"chunkDigest"` // sha256 of the uncompressed chunk
+	Digest      string `json:"digest"`      // sha256 of the whole file
+}
+
+// toc is the JSON document stored as the archive's stargz.index.json entry.
+type toc struct {
+	Entries []TOCEntry `json:"entries"`
+}
+
+// DagArchiveSeekable renders the DAG rooted at nd as a tar.gz laid
+// out per the eStargz convention: every regular file's content is
+// split into chunkSize-ish pieces (aligned to UnixFS block boundaries
+// where possible), each flushed as its own independent gzip member so
+// its compressed byte range can be decompressed in isolation. A final
+// stargz.index.json tar entry lists every chunk's compressed offset
+// and digests, and a fixed-size footer gzip member at the very end of
+// the stream encodes that entry's offset - so a client holding only
+// the last footerSize bytes can locate the TOC and then fetch (and
+// independently decompress) any single file via an HTTP range
+// request, without downloading the rest of the archive.
+//
+// If progress is non-nil, every byte of the uncompressed tar stream
+// for the DAG's own entries (headers and padding included) is also
+// written to it as it's produced, before compression. The trailing
+// stargz.index.json entry and the tar end-of-archive blocks are not.
+func DagArchiveSeekable(ctx context.Context, nd *dag.Node, root string, ds dag.DAGService, chunkSize int64, progress io.Writer) (io.Reader, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	_, root = gopath.Split(root)
+
+	pr, pw := io.Pipe()
+	go func() {
+		if err := writeSeekable(ctx, pw, nd, root, ds, chunkSize, progress); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+	return pr, nil
+}
+
+// countingWriter tracks how many bytes have been written so far, so
+// memberWriter can record each gzip member's starting offset.
+type countingWriter struct {
+	w   io.Writer
+	off int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.off += int64(n)
+	return n, err
+}
+
+// memberWriter lets writeSeekable cut the gzip stream it's producing
+// into independent members without interrupting whatever is writing
+// to it (here, a tar.Writer, which expects one continuous byte
+// stream): Write always goes to the currently open member, and cut
+// closes it and opens a new one at the current compressed offset.
+// Concatenating every member still decompresses, with a standard
+// gzip reader, to the exact tar byte stream that was written.
+type memberWriter struct {
+	out *countingWriter
+	gw  *gzip.Writer
+}
+
+func newMemberWriter(out *countingWriter) (*memberWriter, error) {
+	mw := &memberWriter{out: out}
+	return mw, mw.cut()
+}
+
+func (mw *memberWriter) Write(p []byte) (int, error) {
+	return mw.gw.Write(p)
+}
+
+func (mw *memberWriter) offset() int64 {
+	return mw.out.off
+}
+
+// cut finalizes the current member (if any) and starts a new one.
+func (mw *memberWriter) cut() error {
+	if mw.gw != nil {
+		if err := mw.gw.Close(); err != nil {
+			return err
+		}
+	}
+	mw.gw = gzip.NewWriter(mw.out)
+	return nil
+}
+
+func (mw *memberWriter) Close() error {
+	if mw.gw == nil {
+		return nil
+	}
+	return mw.gw.Close()
+}
+
+func writeSeekable(ctx context.Context, w io.Writer, nd *dag.Node, root string, ds dag.DAGService, chunkSize int64, progress io.Writer) error {
+	cw := &countingWriter{w: w}
+	mw, err := newMemberWriter(cw)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(teeWriter(mw, progress))
+	var entries []TOCEntry
+	if err := walkSeekable(ctx, tw, mw, nd, root, ds, chunkSize, &entries); err != nil {
+		return err
+	}
+	// Flush, not Close: the TOC entry below continues this same tar
+	// stream, so the end-of-archive blocks must come after it.
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// the TOC gets its own member; its tar writer picks up where tw
+	// left off and writes the end-of-archive blocks.
+	if err := mw.cut(); err != nil {
+		return err
+	}
+	tocOffset := mw.offset()
+
+	tocBytes, err := json.Marshal(toc{Entries: entries})
+	if err != nil {
+		return err
+	}
+	tw = tar.NewWriter(mw)
+	if err := tw.WriteHeader(&tar.Header{
+		Name: "stargz.index.json",
+		Size: int64(len(tocBytes)),
+		Mode: 0644,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(tocBytes); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	return writeFooter(cw, tocOffset)
+}
+
+// walkSeekable recursively writes nd into tw, cutting mw at file
+// chunk boundaries and recording a TOCEntry per chunk.
+func walkSeekable(ctx context.Context, tw *tar.Writer, mw *memberWriter, nd *dag.Node, name string, ds dag.DAGService, chunkSize int64, entries *[]TOCEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return err
+	}
+
+	if pbn.GetType() == ftpb.Data_Directory {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0777,
+		}); err != nil {
+			return err
+		}
+		for _, l := range nd.Links {
+			child, err := l.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			if err := walkSeekable(ctx, tw, mw, child, gopath.Join(name, l.Name), ds, chunkSize, entries); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return writeFileSeekable(ctx, tw, mw, nd, name, pbn, ds, chunkSize, entries)
+}
+
+func writeFileSeekable(ctx context.Context, tw *tar.Writer, mw *memberWriter, nd *dag.Node, name string, pbn *ftpb.Data, ds dag.DAGService, chunkSize int64, entries *[]TOCEntry) error {
+	r, err := uio.NewDagReader(ctx, nd, ds)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Size: int64(pbn.GetFilesize()),
+		Mode: 0644,
+	}); err != nil {
+		return err
+	}
+
+	whole := sha256.New()
+	tr := io.TeeReader(r, whole)
+
+	var chunkOffset int64
+	var fileEntries []TOCEntry
+	for _, clen := range fileChunkLengths(pbn, chunkSize) {
+		if err := mw.cut(); err != nil {
+			return err
+		}
+		memberOffset := mw.offset()
+
+		buf := make([]byte, clen)
+		if _, err := io.ReadFull(tr, buf); err != nil {
+			return err
+		}
+		if _, err := tw.Write(buf); err != nil {
+			return err
+		}
+
+		digest := sha256.Sum256(buf)
+		fileEntries = append(fileEntries, TOCEntry{
+			Name:        name,
+			Offset:      memberOffset,
+			ChunkOffset: chunkOffset,
+			ChunkSize:   clen,
+			ChunkDigest: "sha256:" + hex.EncodeToString(digest[:]),
+		})
+		chunkOffset += clen
+	}
+
+	digest := "sha256:" + hex.EncodeToString(whole.Sum(nil))
+	for i := range fileEntries {
+		fileEntries[i].Digest = digest
+	}
+	*entries = append(*entries, fileEntries...)
+	return nil
+}
+
+// fileChunkLengths splits a file of pbn's size into chunkSize-ish
+// pieces, cut at UnixFS block boundaries (via pbn.GetBlocksizes())
+// where available so chunk digests can later be cached per-child-CID;
+// files with no block list (small, single-node files) are a single
+// chunk.
+func fileChunkLengths(pbn *ftpb.Data, chunkSize int64) []int64 {
+	blocks := pbn.GetBlocksizes()
+	if len(blocks) == 0 {
+		return []int64{int64(pbn.GetFilesize())}
+	}
+
+	var lens []int64
+	var acc int64
+	for _, sz := range blocks {
+		acc += int64(sz)
+		if acc >= chunkSize {
+			lens = append(lens, acc)
+			acc = 0
+		}
+	}
+	if acc > 0 {
+		lens = append(lens, acc)
+	}
+	return lens
+}
+
+// writeFooter writes a fixed-length, zero-payload gzip member whose
+// Extra field carries tocOffset, following the eStargz footer
+// convention.
+func writeFooter(w io.Writer, tocOffset int64) error {
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		return err
+	}
+	gw.Extra = []byte(fmt.Sprintf("%016xSTARGZ", tocOffset))
+	if err := gw.Close(); err != nil {
+		return err
+	}
+
+	footer := buf.Bytes()
+	if len(footer) != footerSize {
+		return fmt.Errorf("stargz footer: got %d bytes, want %d", len(footer), footerSize)
+	}
+	_, err = w.Write(footer)
+	return err
+}
@@ -0,0 +1,120 @@
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// TestSeekableFooter checks the fixed-length TOC footer round-trips:
+// a standard gzip.Reader decompresses it to nothing, and its Extra
+// field carries the offset writeFooter was given.
+func TestSeekableFooter(t *testing.T) {
+	var buf bytes.Buffer
+	const tocOffset = 123456
+	if err := writeFooter(&buf, tocOffset); err != nil {
+		t.Fatalf("writeFooter: %v", err)
+	}
+	if buf.Len() != footerSize {
+		t.Fatalf("footer length = %d, want %d", buf.Len(), footerSize)
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	payload, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("read footer member: %v", err)
+	}
+	if len(payload) != 0 {
+		t.Errorf("footer payload = %d bytes, want 0", len(payload))
+	}
+
+	wantExtra := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	if got := string(gr.Header.Extra); got != wantExtra {
+		t.Errorf("footer Extra = %q, want %q", got, wantExtra)
+	}
+}
+
+// TestSeekableRoundTrip archives a small fixture tree with
+// DagArchiveSeekable and checks that: the whole stream is a valid
+// concatenated gzip stream whose decompression is a single tar stream
+// holding the fixture file's content and a stargz.index.json entry,
+// and that the TOC is non-empty and gives the fixture file's chunk the
+// file's full size.
+func TestSeekableRoundTrip(t *testing.T) {
+	root, ds := buildFixtureDag(t)
+
+	r, err := DagArchiveSeekable(context.Background(), root, "root", ds, DefaultChunkSize, nil)
+	if err != nil {
+		t.Fatalf("DagArchiveSeekable: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read archive: %v", err)
+	}
+
+	// gzip.Reader transparently concatenates every independent member,
+	// so the whole stream - tar entries, TOC member, and footer member
+	// alike - must decompress back to one continuous tar stream whose
+	// last entry is the TOC (the footer decompresses to nothing).
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("gzip.NewReader: %v", err)
+	}
+	gr.Multistream(true)
+	plain, err := ioutil.ReadAll(gr)
+	if err != nil {
+		t.Fatalf("decompress archive: %v", err)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(plain))
+	files := map[string][]byte{}
+	var tocBytes []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar.Next: %v", err)
+		}
+		content, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("read tar entry %s: %v", hdr.Name, err)
+		}
+		if hdr.Name == "stargz.index.json" {
+			tocBytes = content
+			continue
+		}
+		files[hdr.Name] = content
+	}
+
+	if string(files["root/hello.txt"]) != helloContent {
+		t.Errorf("root/hello.txt = %q, want %q", files["root/hello.txt"], helloContent)
+	}
+
+	var parsed toc
+	if err := json.Unmarshal(tocBytes, &parsed); err != nil {
+		t.Fatalf("unmarshal TOC: %v", err)
+	}
+	if len(parsed.Entries) == 0 {
+		t.Fatal("TOC has no entries")
+	}
+	for _, e := range parsed.Entries {
+		if e.Name != "root/hello.txt" {
+			continue
+		}
+		if e.ChunkSize != int64(len(helloContent)) {
+			t.Errorf("entry %+v: ChunkSize = %d, want %d", e, e.ChunkSize, len(helloContent))
+		}
+	}
+}
@@ -0,0 +1,164 @@
+// Package tar renders a UnixFS DAG as an archive stream for `ipfs get`.
+package tar
+
+import (
+	"archive/tar"
+	"io"
+	gopath "path"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+	uio "github.com/ipfs/go-ipfs/unixfs/io"
+	ftpb "github.com/ipfs/go-ipfs/unixfs/pb"
+)
+
+// dagArchiver is implemented by formats, such as zip, that lay out
+// their own entries while walking the DAG rather than receiving a
+// flat tar byte stream to wrap.
+type dagArchiver interface {
+	ArchiveWriter
+
+	// ArchiveDag walks nd, writing it to w in this format's native
+	// layout, under the root name root. If progress is non-nil, every
+	// uncompressed byte read from the DAG is also written to it, so a
+	// caller can track real progress against a pre-compression total.
+	ArchiveDag(ctx context.Context, w io.Writer, nd *dag.Node, root string, ds dag.DAGService, progress io.Writer) error
+}
+
+// teeWriter returns dst unchanged if progress is nil; otherwise it
+// returns a writer that duplicates every write to both, so callers
+// can track bytes as they're produced without changing what gets
+// written downstream.
+func teeWriter(dst, progress io.Writer) io.Writer {
+	if progress == nil {
+		return dst
+	}
+	return io.MultiWriter(dst, progress)
+}
+
+// SupportsCDC reports whether format can be used with DagArchiveCDC.
+// DagArchiveCDC rewrites file content into content-defined chunks and
+// feeds them through a single flat tar byte stream; formats that lay
+// out their own entries while walking the DAG instead of wrapping
+// that stream (e.g. zip, via dagArchiver) can't consume it.
+func SupportsCDC(format ArchiveWriter) bool {
+	_, ok := format.(dagArchiver)
+	return !ok
+}
+
+// UsesTarFraming reports whether format lays its output out as a tar
+// stream (headers, payload, per-entry padding) as opposed to walking
+// the DAG and producing its own entry framing (e.g. zip, via
+// dagArchiver). Callers estimating an archive's size ahead of time
+// need to know which size formula applies - tar's fixed per-entry
+// overhead, or just the raw file bytes the format will actually emit.
+func UsesTarFraming(format ArchiveWriter) bool {
+	_, ok := format.(dagArchiver)
+	return !ok
+}
+
+// DagArchive renders the DAG rooted at nd as an archive in the given
+// format, reading the root's display name from root. The returned
+// reader streams the archive as it's produced; any walk or write
+// error aborts the stream.
+//
+// If progress is non-nil, every byte of the uncompressed tar stream
+// (headers, padding and end-of-archive blocks included) is also
+// written to it as it's produced - before format's compression, if
+// any. For a dagArchiver format such as zip, only the file content
+// read out of the DAG is written to it. A caller computing a total
+// ahead of time from the matching size can track real progress
+// against it even when the format compresses its output.
+func DagArchive(ctx context.Context, nd *dag.Node, root string, ds dag.DAGService, format ArchiveWriter, progress io.Writer) (io.Reader, error) {
+	_, root = gopath.Split(root)
+
+	pr, pw := io.Pipe()
+
+	if da, ok := format.(dagArchiver); ok {
+		go func() {
+			if err := da.ArchiveDag(ctx, pw, nd, root, ds, progress); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			pw.Close()
+		}()
+		return pr, nil
+	}
+
+	sink, err := format.NewWriter(pw)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		tw := tar.NewWriter(teeWriter(sink, progress))
+		if err := writeDagToTar(ctx, tw, nd, root, ds); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := tw.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := sink.Close(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	return pr, nil
+}
+
+// writeDagToTar recursively walks nd, writing every file it contains
+// to tw under name. Directories become tar directory entries; their
+// children are visited in turn.
+func writeDagToTar(ctx context.Context, tw *tar.Writer, nd *dag.Node, name string, ds dag.DAGService) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return err
+	}
+
+	if pbn.GetType() == ftpb.Data_Directory {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0777,
+		}); err != nil {
+			return err
+		}
+
+		for _, l := range nd.Links {
+			child, err := l.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			if err := writeDagToTar(ctx, tw, child, gopath.Join(name, l.Name), ds); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, ds)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: name,
+		Size: int64(pbn.GetFilesize()),
+		Mode: 0644,
+	}); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, r)
+	return err
+}
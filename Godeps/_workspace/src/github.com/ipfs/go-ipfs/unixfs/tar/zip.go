@@ -0,0 +1,101 @@
+package tar
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	gopath "path"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+
+	dag "github.com/ipfs/go-ipfs/merkledag"
+	ft "github.com/ipfs/go-ipfs/unixfs"
+	uio "github.com/ipfs/go-ipfs/unixfs/io"
+	ftpb "github.com/ipfs/go-ipfs/unixfs/pb"
+)
+
+// errZipNeedsWalk is returned by the NewWriter-based path, which zip
+// can't actually support: see zipWriteCloser.
+var errZipNeedsWalk = errors.New("zip output requires walking the DAG; use DagArchive, not NewWriter directly")
+
+// zipFormat streams UnixFS files as individual zip entries. Unlike
+// the tar-based formats, zip's central directory can't be produced
+// from a flat byte stream, so zipFormat implements dagArchiver and
+// walks the DAG itself.
+type zipFormat struct{}
+
+func (zipFormat) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	zw := zip.NewWriter(w)
+	return zipWriteCloser{zw}, nil
+}
+
+func (zipFormat) Extension() string   { return ".zip" }
+func (zipFormat) ContentType() string { return "application/zip" }
+
+func (zipFormat) ArchiveDag(ctx context.Context, w io.Writer, nd *dag.Node, root string, ds dag.DAGService, progress io.Writer) error {
+	zw := zip.NewWriter(w)
+	if err := writeDagToZip(ctx, zw, nd, root, ds, progress); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeDagToZip is the zip analogue of writeDagToTar. If progress is
+// non-nil, every uncompressed byte of file content is also written to
+// it as each entry is copied in, before zip's own per-entry deflate
+// compresses it.
+func writeDagToZip(ctx context.Context, zw *zip.Writer, nd *dag.Node, name string, ds dag.DAGService, progress io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	pbn, err := ft.FromBytes(nd.Data)
+	if err != nil {
+		return err
+	}
+
+	if pbn.GetType() == ftpb.Data_Directory {
+		if _, err := zw.Create(name + "/"); err != nil {
+			return err
+		}
+
+		for _, l := range nd.Links {
+			child, err := l.GetNode(ctx, ds)
+			if err != nil {
+				return err
+			}
+			if err := writeDagToZip(ctx, zw, child, gopath.Join(name, l.Name), ds, progress); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	r, err := uio.NewDagReader(ctx, nd, ds)
+	if err != nil {
+		return err
+	}
+
+	fw, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(teeWriter(fw, progress), r)
+	return err
+}
+
+// zipWriteCloser satisfies the ArchiveWriter interface for zipFormat,
+// but zip entries can only be produced by walking the DAG (see
+// ArchiveDag): writes to it always fail.
+type zipWriteCloser struct {
+	zw *zip.Writer
+}
+
+func (z zipWriteCloser) Write(p []byte) (int, error) {
+	return 0, errZipNeedsWalk
+}
+
+func (z zipWriteCloser) Close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,63 @@
+package tar
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	context "github.com/ipfs/go-ipfs/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// TestZipRoundTrip archives a small fixture tree as zip and checks
+// that every file and directory - including an empty subdirectory,
+// which has no content of its own to carry a zip entry otherwise -
+// comes back out via the standard library's zip reader.
+func TestZipRoundTrip(t *testing.T) {
+	root, ds := buildFixtureDag(t)
+
+	var buf bytes.Buffer
+	if err := (zipFormat{}).ArchiveDag(context.Background(), &buf, root, "root", ds, nil); err != nil {
+		t.Fatalf("ArchiveDag: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+
+	entries := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		entries[f.Name] = f
+	}
+
+	if _, ok := entries["root/empty/"]; !ok {
+		t.Errorf("missing directory entry for empty subdirectory; got %v", entryNames(zr.File))
+	}
+
+	f, ok := entries["root/hello.txt"]
+	if !ok {
+		t.Fatalf("missing file entry; got %v", entryNames(zr.File))
+	}
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatalf("open file entry: %v", err)
+	}
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("read file entry: %v", err)
+	}
+	if string(got) != helloContent {
+		t.Errorf("file content = %q, want %q", got, helloContent)
+	}
+}
+
+func entryNames(files []*zip.File) []string {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name
+	}
+	return names
+}